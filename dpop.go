@@ -0,0 +1,284 @@
+// Copyright 2014 The oauth2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oauth2
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "crypto/sha512" // registers crypto.SHA384 and crypto.SHA512
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestAuthorizer attaches credentials to an outgoing request on
+// behalf of a Transport. It is called with a clone of the request the
+// caller made and the token currently held by the Transport.
+type RequestAuthorizer interface {
+	Authorize(req *http.Request, tok *Token) error
+}
+
+// nonceUpdater is implemented by RequestAuthorizers that need to observe
+// responses, such as DPoPAuthorizer reading a DPoP-Nonce header.
+type nonceUpdater interface {
+	UpdateNonce(resp *http.Response)
+}
+
+// bearerAuthorizer is the RequestAuthorizer used when Transport.Authorizer
+// is nil. It reproduces the library's original behavior.
+type bearerAuthorizer struct{}
+
+func (bearerAuthorizer) Authorize(req *http.Request, tok *Token) error {
+	typ := tok.TokenType
+	if typ == "" {
+		typ = defaultTokenType
+	}
+	req.Header.Set("Authorization", typ+" "+tok.AccessToken)
+	return nil
+}
+
+// DPoPAuthorizer implements RFC 9449 Demonstrating Proof-of-Possession.
+// It signs a JWT proof binding the request's method and URL, and the
+// access token's hash, to the holder's key, sets it as the "DPoP"
+// header, and switches the Authorization scheme from Bearer to DPoP.
+//
+// Servers may reply with a "DPoP-Nonce" header asking for a fresh proof
+// carrying that nonce; DPoPAuthorizer tracks the most recent nonce seen
+// per origin and includes it in subsequent proofs once Transport routes
+// responses through UpdateNonce (it does this automatically when the
+// authorizer is installed as Transport.Authorizer).
+type DPoPAuthorizer struct {
+	// Signer produces the proof's signature.
+	Signer crypto.Signer
+
+	// Alg is the JWS "alg" used to sign proofs, e.g. "ES256". Required.
+	Alg string
+
+	// PublicJWK is the JSON-encoded public key placed in each proof's
+	// "jwk" header, e.g. {"kty":"EC","crv":"P-256","x":"...","y":"..."}.
+	PublicJWK json.RawMessage
+
+	mu     sync.Mutex
+	nonces map[string]string // origin -> last DPoP-Nonce seen
+}
+
+// NewDPoPAuthorizer returns a DPoPAuthorizer that signs proofs with
+// signer under alg, advertising publicJWK as the holder key.
+func NewDPoPAuthorizer(signer crypto.Signer, alg string, publicJWK json.RawMessage) *DPoPAuthorizer {
+	return &DPoPAuthorizer{Signer: signer, Alg: alg, PublicJWK: publicJWK}
+}
+
+// Authorize attaches a DPoP proof bound to tok and switches the
+// Authorization header to the "DPoP" scheme.
+func (d *DPoPAuthorizer) Authorize(req *http.Request, tok *Token) error {
+	proof, err := d.proof(req.Method, requestURL(req), tok.AccessToken)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("DPoP", proof)
+	req.Header.Set("Authorization", "DPoP "+tok.AccessToken)
+	return nil
+}
+
+// UpdateNonce records resp's DPoP-Nonce header, if present, to be echoed
+// in the next proof sent to that response's origin.
+func (d *DPoPAuthorizer) UpdateNonce(resp *http.Response) {
+	nonce := resp.Header.Get("DPoP-Nonce")
+	if nonce == "" || resp.Request == nil || resp.Request.URL == nil {
+		return
+	}
+	origin := resp.Request.URL.Scheme + "://" + resp.Request.URL.Host
+
+	d.mu.Lock()
+	if d.nonces == nil {
+		d.nonces = make(map[string]string)
+	}
+	d.nonces[origin] = nonce
+	d.mu.Unlock()
+}
+
+// isDPoPNonceChallenge reports whether resp is a DPoP "use_dpop_nonce"
+// challenge as described in RFC 9449 section 8: a 401 response carrying
+// a fresh "DPoP-Nonce" header and a WWW-Authenticate error of
+// use_dpop_nonce. It calls for resending the same request with a proof
+// that echoes the new nonce, not for discarding the access token.
+func isDPoPNonceChallenge(resp *http.Response) bool {
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	if resp.Header.Get("DPoP-Nonce") == "" {
+		return false
+	}
+	return strings.Contains(strings.ToLower(resp.Header.Get("WWW-Authenticate")), "use_dpop_nonce")
+}
+
+// ProofForTokenRequest returns a DPoP proof with no "ath" claim, for the
+// token endpoint request made by a Transport's fetcher func: set it as
+// the "DPoP" header on that request before sending, so the grant itself
+// is proof-of-possession bound. Transport reaches this automatically
+// through WithTokenRequestProver when Authorizer implements
+// tokenRequestProver; fetchers that build their own token endpoint
+// request should call TokenRequestProverFromContext to retrieve it.
+func (d *DPoPAuthorizer) ProofForTokenRequest(method, rawURL string) (string, error) {
+	return d.proof(method, rawURL, "")
+}
+
+// tokenRequestProver is implemented by RequestAuthorizers, such as
+// DPoPAuthorizer, that can bind the token endpoint request itself to
+// proof-of-possession.
+type tokenRequestProver interface {
+	ProofForTokenRequest(method, rawURL string) (string, error)
+}
+
+type tokenRequestProverKey struct{}
+
+// WithTokenRequestProver returns a copy of ctx carrying prover. Transport
+// calls this before invoking its fetcher func whenever Authorizer
+// implements tokenRequestProver, so a fetcher that builds its own token
+// endpoint request can retrieve prover with
+// TokenRequestProverFromContext and set the resulting proof as that
+// request's "DPoP" header.
+func WithTokenRequestProver(ctx context.Context, prover func(method, rawURL string) (string, error)) context.Context {
+	return context.WithValue(ctx, tokenRequestProverKey{}, prover)
+}
+
+// TokenRequestProverFromContext returns the DPoP token-request proof
+// function Transport attached to ctx, if any.
+func TokenRequestProverFromContext(ctx context.Context) (func(method, rawURL string) (string, error), bool) {
+	prover, ok := ctx.Value(tokenRequestProverKey{}).(func(method, rawURL string) (string, error))
+	return prover, ok
+}
+
+// proof builds and signs a DPoP JWT for method/rawURL. When accessToken
+// is non-empty, the proof includes the "ath" claim required when
+// presenting the proof alongside an access token.
+func (d *DPoPAuthorizer) proof(method, rawURL, accessToken string) (string, error) {
+	if d.Signer == nil || d.Alg == "" {
+		return "", fmt.Errorf("oauth2: DPoPAuthorizer requires Signer and Alg to be set")
+	}
+
+	header := map[string]interface{}{
+		"typ": "dpop+jwt",
+		"alg": d.Alg,
+		"jwk": d.PublicJWK,
+	}
+	claims := map[string]interface{}{
+		"htm": method,
+		"htu": rawURL,
+		"iat": time.Now().Unix(),
+		"jti": newJTI(),
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if nonce := d.nonceFor(rawURL); nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	signingInput, err := encodeJWTSegments(header, claims)
+	if err != nil {
+		return "", err
+	}
+	hash := crypto.SHA256
+	switch {
+	case strings.HasSuffix(d.Alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(d.Alg, "512"):
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	sig, err := d.Signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return "", err
+	}
+	if size, ok := ecdsaSignatureSize[d.Alg]; ok {
+		if sig, err = ecdsaRawSignature(sig, size); err != nil {
+			return "", fmt.Errorf("oauth2: DPoP proof: %w", err)
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// ecdsaSignatureSize gives the raw r||s signature length, in bytes per
+// coordinate, for each ECDSA-based JWS alg. crypto.Signer.Sign on a
+// standard library *ecdsa.PrivateKey returns an ASN.1 DER-encoded
+// signature; JWS (RFC 7518 section 3.4) instead requires this
+// fixed-length concatenation, so ecdsaRawSignature converts between
+// the two.
+var ecdsaSignatureSize = map[string]int{
+	"ES256": 32,
+	"ES384": 48,
+	"ES512": 66,
+}
+
+// ecdsaRawSignature converts an ASN.1 DER ECDSA signature, as returned
+// by crypto.Signer.Sign, into the fixed-length big-endian r||s encoding
+// JWS requires, zero-padding each coordinate to size bytes.
+func ecdsaRawSignature(der []byte, size int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("parsing ASN.1 ECDSA signature: %w", err)
+	}
+	rBytes, sBytes := sig.R.Bytes(), sig.S.Bytes()
+	if len(rBytes) > size || len(sBytes) > size {
+		return nil, fmt.Errorf("ECDSA signature component longer than %d-byte field size", size)
+	}
+	raw := make([]byte, size*2)
+	copy(raw[size-len(rBytes):size], rBytes)
+	copy(raw[size*2-len(sBytes):], sBytes)
+	return raw, nil
+}
+
+func (d *DPoPAuthorizer) nonceFor(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	origin := u.Scheme + "://" + u.Host
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nonces[origin]
+}
+
+// requestURL returns req's URL with the query and fragment stripped, as
+// RFC 9449 section 4.2 requires for the DPoP "htu" claim.
+func requestURL(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+func encodeJWTSegments(header, claims map[string]interface{}) (string, error) {
+	hb, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb), nil
+}
+
+func newJTI() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 The oauth2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDPoPAuthorizer_RawECDSASignature(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	d := &DPoPAuthorizer{Signer: priv, Alg: "ES256", PublicJWK: json.RawMessage(`{"kty":"EC"}`)}
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+
+	if err := d.Authorize(req, &Token{AccessToken: "tok"}); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	proof := req.Header.Get("DPoP")
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a 3-segment JWT, got %q", proof)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("decoding signature segment: %v", err)
+	}
+	if len(sig) != 64 {
+		t.Fatalf("ES256 proof signature: want 64 raw bytes (32-byte r || 32-byte s), got %d", len(sig))
+	}
+}
+
+func TestRequestURL_StripsQueryAndFragment(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/resource?foo=bar&secret=1#frag", nil)
+
+	got := requestURL(req)
+	want := "https://example.com/resource"
+	if got != want {
+		t.Fatalf("requestURL = %q, want %q", got, want)
+	}
+}
+
+func TestDPoPAuthorizer_HtuExcludesQueryAndFragment(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	d := &DPoPAuthorizer{Signer: priv, Alg: "ES256", PublicJWK: json.RawMessage(`{"kty":"EC"}`)}
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/resource?foo=bar&secret=1#frag", nil)
+
+	if err := d.Authorize(req, &Token{AccessToken: "tok"}); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	proof := req.Header.Get("DPoP")
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a 3-segment JWT, got %q", proof)
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("decoding claims segment: %v", err)
+	}
+	var claims struct {
+		Htu string `json:"htu"`
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatalf("unmarshaling claims: %v", err)
+	}
+	if want := "https://example.com/resource"; claims.Htu != want {
+		t.Fatalf("htu claim = %q, want %q", claims.Htu, want)
+	}
+}
+
+func TestEcdsaRawSignature_PadsShortComponents(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	// Sign 64 digests. Each signature has roughly a 1-in-128 chance of an
+	// r or s whose big-endian encoding is shorter than 32 bytes, so a run
+	// reaches the zero-padding path only some of the time (about 2 runs
+	// in 5); every result must still be 64 bytes.
+	for i := 0; i < 64; i++ {
+		digest := make([]byte, 32)
+		digest[0] = byte(i)
+		der, err := priv.Sign(rand.Reader, digest, nil)
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		raw, err := ecdsaRawSignature(der, 32)
+		if err != nil {
+			t.Fatalf("ecdsaRawSignature: %v", err)
+		}
+		if len(raw) != 64 {
+			t.Fatalf("expected 64-byte raw signature, got %d", len(raw))
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 The oauth2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oauth2
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestModifier mutates an outgoing request after Transport's
+// RequestAuthorizer has attached credentials but before it is handed to
+// the base RoundTripper. Modifiers run in the order they appear in
+// Transport.Modifiers.
+type RequestModifier interface {
+	ModifyRequest(req *http.Request) error
+}
+
+// Wrap sets rt as the RoundTripper t delegates to once it has
+// authorized and modified a request, and returns t. It lets a Transport
+// be composed inside another middleware stack instead of always sitting
+// at the bottom:
+//
+//	client.Transport = outerMiddleware(oauthTransport.Wrap(http.DefaultTransport))
+func (t *Transport) Wrap(rt http.RoundTripper) http.RoundTripper {
+	t.base = rt
+	return t
+}
+
+// HeaderModifier injects a fixed set of headers into every request,
+// such as a static API key or client identifier.
+type HeaderModifier http.Header
+
+// ModifyRequest adds h's headers to req.
+func (h HeaderModifier) ModifyRequest(req *http.Request) error {
+	for k, vs := range h {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	return nil
+}
+
+// CorrelationIDModifier sets a correlation ID header on every request.
+type CorrelationIDModifier struct {
+	// Header is the header to set. Defaults to "X-Correlation-ID".
+	Header string
+
+	// Generate returns a new correlation ID. Defaults to a random
+	// 16-byte hex string.
+	Generate func() string
+}
+
+// ModifyRequest sets c.Header to the result of c.Generate on req.
+func (c *CorrelationIDModifier) ModifyRequest(req *http.Request) error {
+	header := c.Header
+	if header == "" {
+		header = "X-Correlation-ID"
+	}
+	gen := c.Generate
+	if gen == nil {
+		gen = newCorrelationID
+	}
+	req.Header.Set(header, gen())
+	return nil
+}
+
+func newCorrelationID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// ImpersonationModifier sets the Impersonate-* headers used by
+// Kubernetes-style APIs to act as another user, analogous to
+// rest.ImpersonationConfig in k8s client-go.
+type ImpersonationModifier struct {
+	// User is sent as the Impersonate-User header.
+	User string
+
+	// Groups are each sent as an Impersonate-Group header.
+	Groups []string
+
+	// Extra entries are each sent as an Impersonate-Extra-<key> header.
+	Extra map[string][]string
+}
+
+// ModifyRequest sets i's impersonation headers on req.
+func (i *ImpersonationModifier) ModifyRequest(req *http.Request) error {
+	if i.User != "" {
+		req.Header.Set("Impersonate-User", i.User)
+	}
+	for _, g := range i.Groups {
+		req.Header.Add("Impersonate-Group", g)
+	}
+	for k, vs := range i.Extra {
+		header := "Impersonate-Extra-" + k
+		for _, v := range vs {
+			req.Header.Add(header, v)
+		}
+	}
+	return nil
+}
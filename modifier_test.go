@@ -0,0 +1,192 @@
+// Copyright 2014 The oauth2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oauth2
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// recordingModifier appends its name to calls each time it runs, and
+// captures the Authorization header the request carried at that point.
+type recordingModifier struct {
+	name  string
+	calls *[]string
+	auth  *string
+	err   error
+}
+
+func (m recordingModifier) ModifyRequest(req *http.Request) error {
+	*m.calls = append(*m.calls, m.name)
+	if m.auth != nil {
+		*m.auth = req.Header.Get("Authorization")
+	}
+	return m.err
+}
+
+func TestApplyModifiers_RunInOrderAfterAuthorizer(t *testing.T) {
+	var calls []string
+	var authAtFirst string
+
+	tr := newTransport(nil, nil, &Token{AccessToken: "at-1"})
+	tr.Modifiers = []RequestModifier{
+		recordingModifier{name: "first", calls: &calls, auth: &authAtFirst},
+		recordingModifier{name: "second", calls: &calls},
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	if err := tr.authorizer().Authorize(req, tr.Token()); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if err := tr.applyModifiers(req); err != nil {
+		t.Fatalf("applyModifiers: %v", err)
+	}
+
+	if want := []string{"first", "second"}; len(calls) != len(want) || calls[0] != want[0] || calls[1] != want[1] {
+		t.Fatalf("expected modifiers to run in order %v, got %v", want, calls)
+	}
+	if authAtFirst != "Bearer at-1" {
+		t.Fatalf("expected the Authorization header to already be set before modifiers run, got %q", authAtFirst)
+	}
+}
+
+func TestApplyModifiers_StopsAtFirstError(t *testing.T) {
+	var calls []string
+	wantErr := errors.New("modifier boom")
+
+	tr := newTransport(nil, nil, &Token{AccessToken: "at-1"})
+	tr.Modifiers = []RequestModifier{
+		recordingModifier{name: "first", calls: &calls, err: wantErr},
+		recordingModifier{name: "second", calls: &calls},
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	err := tr.applyModifiers(req)
+	if err != wantErr {
+		t.Fatalf("applyModifiers error = %v, want %v", err, wantErr)
+	}
+	if want := []string{"first"}; len(calls) != len(want) || calls[0] != want[0] {
+		t.Fatalf("expected only the failing modifier to run, got %v", calls)
+	}
+}
+
+func TestHeaderModifier_AddsAllValues(t *testing.T) {
+	h := HeaderModifier(http.Header{
+		"X-Api-Key": []string{"secret"},
+		"X-Client":  []string{"a", "b"},
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	if err := h.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest: %v", err)
+	}
+
+	if got := req.Header.Get("X-Api-Key"); got != "secret" {
+		t.Fatalf("X-Api-Key = %q, want %q", got, "secret")
+	}
+	if got := req.Header.Values("X-Client"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("X-Client = %v, want [a b]", got)
+	}
+}
+
+func TestCorrelationIDModifier_DefaultsHeaderAndGenerator(t *testing.T) {
+	c := &CorrelationIDModifier{}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	if err := c.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest: %v", err)
+	}
+
+	if got := req.Header.Get("X-Correlation-ID"); got == "" {
+		t.Fatalf("expected a generated X-Correlation-ID header to be set")
+	}
+}
+
+func TestCorrelationIDModifier_UsesConfiguredHeaderAndGenerate(t *testing.T) {
+	c := &CorrelationIDModifier{
+		Header:   "X-Request-ID",
+		Generate: func() string { return "fixed-id" },
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	if err := c.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest: %v", err)
+	}
+
+	if got := req.Header.Get("X-Request-ID"); got != "fixed-id" {
+		t.Fatalf("X-Request-ID = %q, want %q", got, "fixed-id")
+	}
+	if req.Header.Get("X-Correlation-ID") != "" {
+		t.Fatalf("expected the default header to be left unset")
+	}
+}
+
+func TestImpersonationModifier_SetsUserGroupsAndExtraHeaders(t *testing.T) {
+	i := &ImpersonationModifier{
+		User:   "alice",
+		Groups: []string{"admins", "devs"},
+		Extra: map[string][]string{
+			"reason": {"debugging", "on-call"},
+		},
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	if err := i.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest: %v", err)
+	}
+
+	if got := req.Header.Get("Impersonate-User"); got != "alice" {
+		t.Fatalf("Impersonate-User = %q, want %q", got, "alice")
+	}
+	if got := req.Header.Values("Impersonate-Group"); len(got) != 2 || got[0] != "admins" || got[1] != "devs" {
+		t.Fatalf("Impersonate-Group = %v, want [admins devs]", got)
+	}
+	if got := req.Header.Values("Impersonate-Extra-reason"); len(got) != 2 || got[0] != "debugging" || got[1] != "on-call" {
+		t.Fatalf("Impersonate-Extra-reason = %v, want [debugging on-call]", got)
+	}
+}
+
+func TestImpersonationModifier_OmitsUserHeaderWhenEmpty(t *testing.T) {
+	i := &ImpersonationModifier{Groups: []string{"admins"}}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	if err := i.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest: %v", err)
+	}
+
+	if req.Header.Get("Impersonate-User") != "" {
+		t.Fatalf("expected no Impersonate-User header when User is empty")
+	}
+}
+
+func TestWrap_SetsBaseRoundTripperAndReturnsTransport(t *testing.T) {
+	tr := newTransport(nil, nil, &Token{AccessToken: "at-1"})
+	rt := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return newResp(nil, http.StatusOK, nil), nil
+	})
+
+	got := tr.Wrap(rt)
+	if got != tr {
+		t.Fatalf("Wrap should return the same *Transport")
+	}
+
+	resp, err := tr.RoundTrip(mustGetRequest(t))
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected RoundTrip to delegate to the wrapped RoundTripper, got status %d", resp.StatusCode)
+	}
+}
+
+func mustGetRequest(t *testing.T) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	return req
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 The oauth2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oauth2
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileTokenSource is a TokenSource that reads a bearer token from a file
+// on disk, such as a Kubernetes projected service account token. The
+// token is reloaded whenever the file's modification time changes or,
+// if ReloadInterval is set, after it has elapsed since the last load.
+type FileTokenSource struct {
+	// Path is the location of the token file.
+	Path string
+
+	// ReloadInterval forces a re-read of Path after this much time has
+	// passed, even if the file's mtime is unchanged. Zero disables the
+	// time-based reload and relies solely on mtime.
+	ReloadInterval time.Duration
+
+	mu       sync.Mutex
+	token    *Token
+	modTime  time.Time
+	loadedAt time.Time
+}
+
+// NewFileTokenSource returns a FileTokenSource that reads the bearer
+// token from path.
+func NewFileTokenSource(path string) *FileTokenSource {
+	return &FileTokenSource{Path: path}
+}
+
+// Token returns the token currently on disk at f.Path, re-reading the
+// file if it has changed or gone stale. Reading is local and does not
+// block on ctx, but ctx is still checked up front so a caller who has
+// already given up does not pay for a stat/read.
+func (f *FileTokenSource) Token(ctx context.Context) (*Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := f.token == nil || !fi.ModTime().Equal(f.modTime)
+	if !stale && f.ReloadInterval > 0 {
+		stale = time.Since(f.loadedAt) >= f.ReloadInterval
+	}
+	if !stale {
+		return f.token, nil
+	}
+
+	b, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	f.token = &Token{
+		AccessToken: strings.TrimSpace(string(b)),
+		TokenType:   defaultTokenType,
+	}
+	f.modTime = fi.ModTime()
+	f.loadedAt = time.Now()
+	return f.token, nil
+}
+
+// CachedTokenSource wraps another TokenSource and returns its last
+// fetched Token until that token is within Leeway of Expiry, at which
+// point a single call to the wrapped Source refreshes it. Concurrent
+// callers racing a reload collapse onto the same underlying fetch.
+//
+// Some TokenSources, such as FileTokenSource, have no notion of Expiry
+// at all: the credential is replaced out-of-band and simply read again.
+// For a cached Token with a zero Expiry, CachedTokenSource instead
+// re-delegates to Source once Leeway has elapsed since the last fetch,
+// so a cache wrapped around such a source still observes rotation
+// rather than freezing on the first value it ever read.
+type CachedTokenSource struct {
+	// Source is the wrapped TokenSource that performs the real fetch.
+	Source TokenSource
+
+	// Leeway is how far ahead of Expiry a reload is triggered. For a
+	// token with no Expiry, it is instead the interval at which Source
+	// is polled again. Zero means refresh only once the token has
+	// actually expired, or never, for a token with no Expiry.
+	Leeway time.Duration
+
+	mu        sync.Mutex
+	token     *Token
+	fetchedAt time.Time
+}
+
+// NewCachedTokenSource returns a CachedTokenSource wrapping src with the
+// default one minute leeway.
+func NewCachedTokenSource(src TokenSource) *CachedTokenSource {
+	return &CachedTokenSource{Source: src, Leeway: time.Minute}
+}
+
+// Token returns the cached token, reloading from Source if it is within
+// Leeway of expiry (or, for a token with no Expiry, if Leeway has
+// elapsed since it was fetched).
+func (c *CachedTokenSource) Token(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != nil && !c.expiredLocked() {
+		return c.token, nil
+	}
+
+	token, err := c.Source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.token = token
+	c.fetchedAt = time.Now()
+	return token, nil
+}
+
+func (c *CachedTokenSource) expiredLocked() bool {
+	if c.token.AccessToken == "" {
+		return true
+	}
+	if c.token.Expiry.IsZero() {
+		return c.Leeway > 0 && time.Since(c.fetchedAt) >= c.Leeway
+	}
+	return c.token.Expiry.Add(-c.Leeway).Before(time.Now())
+}
@@ -0,0 +1,166 @@
+// Copyright 2014 The oauth2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oauth2
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countingSource returns an incrementing access token on every call, and
+// never sets Expiry, mirroring a file-backed bearer token.
+type countingSource struct {
+	calls int
+}
+
+func (s *countingSource) Token(ctx context.Context) (*Token, error) {
+	s.calls++
+	return &Token{AccessToken: string(rune('a' + s.calls - 1))}, nil
+}
+
+func TestCachedTokenSource_ZeroExpiryReloadsAfterLeeway(t *testing.T) {
+	src := &countingSource{}
+	c := &CachedTokenSource{Source: src, Leeway: 10 * time.Millisecond}
+
+	tok, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if src.calls != 1 {
+		t.Fatalf("expected 1 call to Source, got %d", src.calls)
+	}
+
+	// Within the leeway window, the cached token with no Expiry should
+	// be reused rather than re-fetched.
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if src.calls != 1 {
+		t.Fatalf("expected cached token to be reused, got %d calls", src.calls)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	tok2, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if src.calls != 2 {
+		t.Fatalf("expected a reload after Leeway elapsed, got %d calls", src.calls)
+	}
+	if tok2.AccessToken == tok.AccessToken {
+		t.Fatalf("expected a rotated token after reload, got the same value %q", tok2.AccessToken)
+	}
+}
+
+func writeTokenFile(t *testing.T, path, contents string) time.Time {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	return fi.ModTime()
+}
+
+func TestFileTokenSource_InitialRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeTokenFile(t, path, "tok-1\n")
+
+	f := NewFileTokenSource(path)
+	tok, err := f.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if tok.AccessToken != "tok-1" {
+		t.Fatalf("AccessToken = %q, want %q", tok.AccessToken, "tok-1")
+	}
+	if tok.TokenType != defaultTokenType {
+		t.Fatalf("TokenType = %q, want %q", tok.TokenType, defaultTokenType)
+	}
+}
+
+func TestFileTokenSource_ReloadsOnMtimeChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeTokenFile(t, path, "tok-1\n")
+
+	f := NewFileTokenSource(path)
+	if _, err := f.Token(context.Background()); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+
+	modTime := writeTokenFile(t, path, "tok-2\n")
+	// Some filesystems truncate mtime resolution; force it forward to
+	// guarantee the write is observed as a change.
+	newModTime := modTime.Add(time.Second)
+	if err := os.Chtimes(path, newModTime, newModTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	tok, err := f.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if tok.AccessToken != "tok-2" {
+		t.Fatalf("AccessToken = %q, want %q after mtime changed", tok.AccessToken, "tok-2")
+	}
+}
+
+func TestFileTokenSource_ReloadIntervalTriggersReloadWithUnchangedMtime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	modTime := writeTokenFile(t, path, "tok-1\n")
+
+	f := NewFileTokenSource(path)
+	f.ReloadInterval = 10 * time.Millisecond
+	if _, err := f.Token(context.Background()); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+
+	// Rewrite with new contents but pin the file back to its original
+	// mtime, so only ReloadInterval elapsing can explain a reload.
+	writeTokenFile(t, path, "tok-2\n")
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	tok, err := f.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if tok.AccessToken != "tok-2" {
+		t.Fatalf("AccessToken = %q, want %q after ReloadInterval elapsed", tok.AccessToken, "tok-2")
+	}
+}
+
+func TestFileTokenSource_StatError(t *testing.T) {
+	f := NewFileTokenSource(filepath.Join(t.TempDir(), "missing"))
+
+	if _, err := f.Token(context.Background()); err == nil {
+		t.Fatalf("expected an error for a missing token file")
+	}
+}
+
+func TestCachedTokenSource_ZeroLeewayNeverReloadsZeroExpiry(t *testing.T) {
+	src := &countingSource{}
+	c := &CachedTokenSource{Source: src}
+
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if src.calls != 1 {
+		t.Fatalf("expected no reload with zero Leeway, got %d calls", src.calls)
+	}
+}
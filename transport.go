@@ -5,6 +5,8 @@
 package oauth2
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
@@ -13,6 +15,11 @@ import (
 
 const (
 	defaultTokenType = "Bearer"
+
+	// defaultLeeway is how far ahead of its actual Expiry a token is
+	// treated as expired, so that a refresh has time to complete before
+	// the old token is rejected by the server.
+	defaultLeeway = 60 * time.Second
 )
 
 // Token represents the crendentials used to authorize
@@ -55,57 +62,187 @@ func (t *Token) Extra(key string) string {
 // Expired returns true if there is no access token or the
 // access token is expired.
 func (t *Token) Expired() bool {
+	return t.expired(0)
+}
+
+// expired reports whether the token has no access token or is within
+// leeway of its Expiry.
+func (t *Token) expired(leeway time.Duration) bool {
 	if t.AccessToken == "" {
 		return true
 	}
 	if t.Expiry.IsZero() {
 		return false
 	}
-	return t.Expiry.Before(time.Now())
+	return t.Expiry.Add(-leeway).Before(time.Now())
+}
+
+// TokenSource supplies a *Token on demand. Implementations are free to
+// cache, refresh, or re-read the token from wherever it is kept; callers
+// must treat the returned Token as a read-only snapshot. Implementations
+// should return ctx.Err() promptly if ctx is done before a token is
+// available.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
 }
 
 // Transport is an http.RoundTripper that makes OAuth 2.0 HTTP requests.
 type Transport struct {
-	fetcher func(t *Token) (*Token, error)
+	fetcher func(ctx context.Context, t *Token) (*Token, error)
+	source  TokenSource
 	base    http.RoundTripper
 
-	mu    sync.RWMutex
+	// RetryOn401, if true, causes RoundTrip to invalidate the token and
+	// retry once with a freshly fetched one when the base transport
+	// returns a 401 for a request that was sent with the then-current
+	// token.
+	RetryOn401 bool
+
+	// RefreshTimeout, if set, bounds how long a single token refresh may
+	// take by wrapping the caller's context with a deadline.
+	RefreshTimeout time.Duration
+
+	// Leeway is how far ahead of Expiry a token is considered expired,
+	// both by RoundTrip and by the background refresh started with
+	// StartAutoRefresh. Zero means defaultLeeway.
+	Leeway time.Duration
+
+	// Authorizer attaches the token to outgoing requests. Nil means the
+	// default bearer Authorization header.
+	Authorizer RequestAuthorizer
+
+	// Modifiers run in order on each outgoing request after Authorizer
+	// has set credentials but before it is handed to base.
+	Modifiers []RequestModifier
+
+	mu         sync.RWMutex
+	token      *Token
+	issued     time.Time
+	lastRefErr error
+
+	refreshMu  sync.Mutex
+	refreshing *tokenRefresh
+	autoCancel context.CancelFunc
+}
+
+// tokenRefresh represents a single in-flight call to RefreshToken.
+// Concurrent callers that arrive while one is in progress wait on done
+// rather than starting a redundant fetch.
+type tokenRefresh struct {
+	done  chan struct{}
 	token *Token
+	err   error
 }
 
 // NewTransport creates a new Transport that uses the provided
 // token fetcher as token retrieving strategy. It authenticates
 // the requests and delegates origTransport to make the actual requests.
-func newTransport(base http.RoundTripper, fn func(t *Token) (*Token, error), token *Token) *Transport {
+func newTransport(base http.RoundTripper, fn func(ctx context.Context, t *Token) (*Token, error), token *Token) *Transport {
 	return &Transport{base: base, fetcher: fn, token: token}
 }
 
+// newTransportWithSource creates a new Transport that refreshes its token
+// by calling src.Token(ctx) instead of invoking a fetcher func directly.
+// This is the entry point for credentials that are provisioned
+// out-of-band, such as a file-backed TokenSource.
+func newTransportWithSource(base http.RoundTripper, src TokenSource, token *Token) *Transport {
+	return &Transport{base: base, source: src, token: token}
+}
+
 // RoundTrip authorizes and authenticates the request with an
 // access token. If no token exists or token is expired,
 // tries to refresh/fetch a new token.
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	sentAt := time.Now()
 	token := t.Token()
 
-	if token == nil || token.Expired() {
+	if token == nil || token.expired(t.leeway()) {
 		// Check if the token is refreshable.
 		// If token is refreshable, don't return an error,
 		// rather refresh.
-		if err := t.RefreshToken(); err != nil {
+		if err := t.RefreshToken(req.Context()); err != nil {
 			return nil, err
 		}
 		token = t.Token()
 	}
 
+	resp, err = t.sendAuthorized(req, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// A DPoP "use_dpop_nonce" challenge only tells us the proof needs a
+	// server-issued nonce, which sendAuthorized's call to noteNonce has
+	// already recorded; it says nothing about the access token, so
+	// retry with the same token rather than treating it as stale.
+	if isDPoPNonceChallenge(resp) {
+		resp.Body.Close()
+		if err := rewindBody(req); err != nil {
+			return nil, err
+		}
+		return t.sendAuthorized(req, token)
+	}
+
+	if !t.RetryOn401 {
+		return resp, err
+	}
+
+	// The token we sent was rejected. If it hasn't already been
+	// refreshed by someone else since we sent it, invalidate it and
+	// retry once with a freshly fetched token.
+	if !t.ResetTokenOlderThan(sentAt) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	if err := t.RefreshToken(req.Context()); err != nil {
+		return nil, err
+	}
+	if err := rewindBody(req); err != nil {
+		return nil, err
+	}
+	return t.sendAuthorized(req, t.Token())
+}
+
+// rewindBody replaces req.Body with a fresh reader from req.GetBody
+// before a retried attempt, since the first attempt's sendAuthorized
+// call already drained and closed req.Body on base.RoundTrip. It is a
+// no-op for a bodyless request, and errors rather than silently
+// resending an empty body when req has a Body but no GetBody to rewind
+// it with (http.NewRequest populates GetBody for common Body types).
+func rewindBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.GetBody == nil {
+		return fmt.Errorf("oauth2: cannot retry a request whose Body has no GetBody to rewind it with")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+// sendAuthorized clones req, authorizes and modifies the clone, and
+// sends it on base. It is the single place RoundTrip constructs an
+// outgoing request, so the initial attempt and any retry authorize
+// identically.
+func (t *Transport) sendAuthorized(req *http.Request, token *Token) (*http.Response, error) {
 	// To set the Authorization header, we must make a copy of the Request
 	// so that we don't modify the Request we were given.
 	// This is required by the specification of http.RoundTripper.
-	req = cloneRequest(req)
-	typ := token.TokenType
-	if typ == "" {
-		typ = defaultTokenType
+	authReq := cloneRequest(req)
+	if err := t.authorizer().Authorize(authReq, token); err != nil {
+		return nil, err
 	}
-	req.Header.Set("Authorization", typ+" "+token.AccessToken)
-	return t.base.RoundTrip(req)
+	if err := t.applyModifiers(authReq); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authReq)
+	t.noteNonce(resp)
+	return resp, err
 }
 
 // Token returns the token that authorizes and
@@ -121,22 +258,222 @@ func (t *Transport) SetToken(v *Token) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.token = v
+	t.issued = time.Now()
 }
 
-// RefreshToken retrieves a new token, if a refreshing/fetching
-// method is known and required credentials are presented
-// (such as a refresh token).
-func (t *Transport) RefreshToken() error {
+// ResetTokenOlderThan clears the current token if it was issued before
+// cutoff, forcing the next RoundTrip to refresh. It reports whether the
+// token was reset. This lets a caller that observed a stale token (e.g.
+// a 401 response) force a re-fetch without racing a concurrent refresh
+// that may have already replaced it.
+func (t *Transport) ResetTokenOlderThan(cutoff time.Time) bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	token, err := t.fetcher(t.token)
-	if err != nil {
-		return err
+	if t.token == nil || t.issued.Before(cutoff) {
+		t.token = nil
+		return true
+	}
+	return false
+}
+
+// RefreshToken retrieves a new token, if a refreshing/fetching
+// method is known and required credentials are presented
+// (such as a refresh token). Concurrent callers collapse onto a single
+// in-flight refresh and all receive its result; the struct lock is not
+// held across the network round-trip to the token endpoint.
+//
+// ctx bounds only this call's wait for that result: if ctx is done
+// first, RefreshToken returns ctx.Err() without affecting the refresh
+// itself, which runs on its own detached context (plus t.RefreshTimeout,
+// if set) so that one caller giving up can never cancel or shorten the
+// fetch that every other concurrent caller is also waiting on.
+func (t *Transport) RefreshToken(ctx context.Context) error {
+	t.refreshMu.Lock()
+	r := t.refreshing
+	if r == nil {
+		r = &tokenRefresh{done: make(chan struct{})}
+		t.refreshing = r
+		t.refreshMu.Unlock()
+		// WithoutCancel keeps any values ctx carries (e.g. for tracing)
+		// reachable from the fetch without letting this particular
+		// caller's cancellation or deadline reach it.
+		go t.doRefresh(context.WithoutCancel(ctx), r)
+	} else {
+		t.refreshMu.Unlock()
+	}
+
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// doRefresh performs the actual fetch for a single-flight refresh r, on
+// a context detached from any individual caller's lifetime so that
+// cancelling one caller's request can't cut the fetch short for the
+// others waiting on r.done.
+func (t *Transport) doRefresh(ctx context.Context, r *tokenRefresh) {
+	if t.RefreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.RefreshTimeout)
+		defer cancel()
+	}
+
+	if p, ok := t.authorizer().(tokenRequestProver); ok {
+		ctx = WithTokenRequestProver(ctx, p.ProofForTokenRequest)
+	}
+
+	current := t.Token()
+	var token *Token
+	var err error
+	if t.source != nil {
+		token, err = t.source.Token(ctx)
+	} else {
+		token, err = t.fetcher(ctx, current)
+	}
+	r.token, r.err = token, err
+	if err == nil {
+		t.SetToken(token)
+	}
+
+	t.refreshMu.Lock()
+	t.refreshing = nil
+	t.refreshMu.Unlock()
+	close(r.done)
+}
+
+// authorizer returns t.Authorizer, or the default bearer authorizer if
+// it is unset.
+func (t *Transport) authorizer() RequestAuthorizer {
+	if t.Authorizer != nil {
+		return t.Authorizer
+	}
+	return bearerAuthorizer{}
+}
+
+// noteNonce lets a nonce-tracking RequestAuthorizer, such as
+// DPoPAuthorizer, observe the response so it can echo any server-issued
+// nonce in its next proof.
+func (t *Transport) noteNonce(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	if nu, ok := t.authorizer().(nonceUpdater); ok {
+		nu.UpdateNonce(resp)
+	}
+}
+
+// applyModifiers runs t.Modifiers over req in order, stopping at the
+// first error.
+func (t *Transport) applyModifiers(req *http.Request) error {
+	for _, m := range t.Modifiers {
+		if err := m.ModifyRequest(req); err != nil {
+			return err
+		}
 	}
-	t.token = token
 	return nil
 }
 
+// leeway returns t.Leeway, or defaultLeeway if it is unset.
+func (t *Transport) leeway() time.Duration {
+	if t.Leeway > 0 {
+		return t.Leeway
+	}
+	return defaultLeeway
+}
+
+// StartAutoRefresh starts a background goroutine that refreshes the
+// token shortly before it expires, so that callers on the RoundTrip
+// critical path rarely pay refresh latency. It is a no-op if a refresh
+// loop is already running. The loop stops when ctx is done or Stop is
+// called; call Stop to release its goroutine.
+func (t *Transport) StartAutoRefresh(ctx context.Context) {
+	t.refreshMu.Lock()
+	if t.autoCancel != nil {
+		t.refreshMu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t.autoCancel = cancel
+	t.refreshMu.Unlock()
+
+	go t.autoRefreshLoop(ctx)
+}
+
+// Stop cancels a refresh loop previously started with StartAutoRefresh.
+// It is a no-op if none is running.
+func (t *Transport) Stop() {
+	t.refreshMu.Lock()
+	cancel := t.autoCancel
+	t.autoCancel = nil
+	t.refreshMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// LastRefreshError returns the error from the most recent background
+// refresh attempt started by StartAutoRefresh, or nil if the last
+// attempt succeeded or none has happened yet.
+func (t *Transport) LastRefreshError() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.lastRefErr
+}
+
+func (t *Transport) setLastRefreshError(err error) {
+	t.mu.Lock()
+	t.lastRefErr = err
+	t.mu.Unlock()
+}
+
+// autoRefreshLoop waits until the current token is within leeway of
+// expiry, then refreshes it, backing off between retries on failure.
+func (t *Transport) autoRefreshLoop(ctx context.Context) {
+	backoff := time.Second
+	const maxBackoff = time.Minute
+
+	for {
+		wait := t.leeway()
+		token := t.Token()
+		switch {
+		case token == nil:
+			// No token fetched yet: refresh immediately rather than
+			// sitting idle for a full leeway.
+			wait = 0
+		case !token.Expiry.IsZero():
+			if d := time.Until(token.Expiry.Add(-t.leeway())); d > 0 {
+				wait = d
+			} else {
+				wait = 0
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if err := t.RefreshToken(ctx); err != nil {
+			t.setLastRefreshError(err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		t.setLastRefreshError(nil)
+		backoff = time.Second
+	}
+}
+
 // cloneRequest returns a clone of the provided *http.Request.
 // The clone is a shallow copy of the struct and its Header map.
 func cloneRequest(r *http.Request) *http.Request {
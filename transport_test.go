@@ -0,0 +1,523 @@
+// Copyright 2014 The oauth2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package oauth2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// newResp builds a response to req, setting resp.Request as a real
+// RoundTripper would so that nonce tracking (which keys off the
+// response's request URL) has something to read.
+func newResp(req *http.Request, status int, header http.Header) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}
+}
+
+func newDPoPAuthorizer(t *testing.T) *DPoPAuthorizer {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return &DPoPAuthorizer{Signer: priv, Alg: "ES256", PublicJWK: json.RawMessage(`{"kty":"EC"}`)}
+}
+
+// TestRoundTrip_DPoPNonceChallengeDoesNotRefreshToken verifies that a
+// "use_dpop_nonce" 401 challenge is answered by resending with an
+// updated proof, not by invalidating and refetching the access token.
+func TestRoundTrip_DPoPNonceChallengeDoesNotRefreshToken(t *testing.T) {
+	calls := 0
+	var secondProof string
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			if req.Header.Get("DPoP") == "" {
+				t.Fatalf("expected a DPoP proof on the first attempt")
+			}
+			h := make(http.Header)
+			h.Set("DPoP-Nonce", "server-nonce-1")
+			h.Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+			return newResp(req, http.StatusUnauthorized, h), nil
+		}
+		secondProof = req.Header.Get("DPoP")
+		return newResp(req, http.StatusOK, nil), nil
+	})
+
+	fetcherCalls := 0
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		fetcherCalls++
+		return nil, errors.New("fetcher should not be invoked for a nonce challenge")
+	}
+
+	tr := newTransport(base, fetcher, &Token{AccessToken: "at-1"})
+	tr.Authorizer = newDPoPAuthorizer(t)
+	tr.RetryOn401 = true
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after resending with the nonce, got %d", resp.StatusCode)
+	}
+	if calls != 2 {
+		t.Fatalf("expected exactly one retry, base was called %d times", calls)
+	}
+	if fetcherCalls != 0 {
+		t.Fatalf("expected the token fetcher to be untouched, got %d calls", fetcherCalls)
+	}
+	if tr.Token().AccessToken != "at-1" {
+		t.Fatalf("expected the original token to still be current, got %q", tr.Token().AccessToken)
+	}
+	if !strings.Contains(decodeJWTClaims(t, secondProof), `"server-nonce-1"`) {
+		t.Fatalf("expected the retried proof to carry the server nonce, got claims %s", decodeJWTClaims(t, secondProof))
+	}
+}
+
+// decodeJWTClaims base64url-decodes the claims segment of a two-dot JWT
+// for assertions; it is not a general-purpose JWT parser.
+func decodeJWTClaims(t *testing.T, jwt string) string {
+	t.Helper()
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a 3-segment JWT, got %q", jwt)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("decoding claims segment: %v", err)
+	}
+	return string(b)
+}
+
+// TestRefreshToken_ThreadsDPoPProverToFetcher verifies that RefreshToken
+// makes the Authorizer's token-request proof reachable to a fetcher that
+// builds its own request to the token endpoint, so that grant itself can
+// be proof-of-possession bound.
+func TestRefreshToken_ThreadsDPoPProverToFetcher(t *testing.T) {
+	var gotProof string
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		prover, ok := TokenRequestProverFromContext(ctx)
+		if !ok {
+			t.Fatalf("expected a DPoP token-request prover in ctx")
+		}
+		proof, err := prover(http.MethodPost, "https://example.com/token")
+		if err != nil {
+			t.Fatalf("prover: %v", err)
+		}
+		gotProof = proof
+		return &Token{AccessToken: "at-2"}, nil
+	}
+
+	tr := newTransport(nil, fetcher, &Token{AccessToken: "at-1"})
+	tr.Authorizer = newDPoPAuthorizer(t)
+
+	if err := tr.RefreshToken(context.Background()); err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+	if gotProof == "" {
+		t.Fatalf("expected the fetcher to receive a non-empty proof")
+	}
+	if strings.Contains(decodeJWTClaims(t, gotProof), `"ath"`) {
+		t.Fatalf("token request proof must not carry an \"ath\" claim, got %s", decodeJWTClaims(t, gotProof))
+	}
+}
+
+// TestRefreshToken_NoProverWithoutDPoPAuthorizer verifies that a plain
+// bearer-authorized Transport does not attach a token-request prover,
+// since there is nothing for a non-DPoP fetcher to call.
+func TestRefreshToken_NoProverWithoutDPoPAuthorizer(t *testing.T) {
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		if _, ok := TokenRequestProverFromContext(ctx); ok {
+			t.Fatalf("expected no token-request prover without a DPoP authorizer")
+		}
+		return &Token{AccessToken: "at-2"}, nil
+	}
+
+	tr := newTransport(nil, fetcher, &Token{AccessToken: "at-1"})
+	if err := tr.RefreshToken(context.Background()); err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+}
+
+// TestRoundTrip_RetryOn401RefreshesStaleToken verifies the pre-existing
+// 401 retry path still refreshes and resends when the rejection is an
+// ordinary stale-token 401, not a DPoP nonce challenge.
+func TestRoundTrip_RetryOn401RefreshesStaleToken(t *testing.T) {
+	calls := 0
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			return newResp(req, http.StatusUnauthorized, nil), nil
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer at-2" {
+			t.Fatalf("expected retry to use the refreshed token, got %q", got)
+		}
+		return newResp(req, http.StatusOK, nil), nil
+	})
+
+	fetcherCalls := 0
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		fetcherCalls++
+		return &Token{AccessToken: "at-2"}, nil
+	}
+
+	tr := newTransport(base, fetcher, &Token{AccessToken: "at-1"})
+	tr.RetryOn401 = true
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after refresh and retry, got %d", resp.StatusCode)
+	}
+	if fetcherCalls != 1 {
+		t.Fatalf("expected exactly one refresh, got %d", fetcherCalls)
+	}
+}
+
+// TestRoundTrip_RetryOn401SkipsRefreshIfTokenAlreadyRotated verifies
+// that ResetTokenOlderThan prevents a redundant refresh when another
+// caller already replaced the token between send and the 401 response.
+func TestRoundTrip_RetryOn401SkipsRefreshIfTokenAlreadyRotated(t *testing.T) {
+	var tr *Transport
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		// Simulate a concurrent refresh completing while this request
+		// was in flight.
+		tr.SetToken(&Token{AccessToken: "at-2"})
+		return newResp(req, http.StatusUnauthorized, nil), nil
+	})
+
+	fetcherCalls := 0
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		fetcherCalls++
+		return &Token{AccessToken: "at-3"}, nil
+	}
+
+	tr = newTransport(base, fetcher, &Token{AccessToken: "at-1"})
+	tr.RetryOn401 = true
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the 401 to be returned without a second attempt, got %d", resp.StatusCode)
+	}
+	if fetcherCalls != 0 {
+		t.Fatalf("expected no refresh since the token had already rotated, got %d calls", fetcherCalls)
+	}
+	if got := tr.Token().AccessToken; got != "at-2" {
+		t.Fatalf("expected the concurrently-set token to survive, got %q", got)
+	}
+}
+
+// TestRoundTrip_RetryOn401ResendsOriginalBody verifies that a 401 retry
+// resends the request's original body rather than the now-drained
+// io.ReadCloser the first attempt already consumed.
+func TestRoundTrip_RetryOn401ResendsOriginalBody(t *testing.T) {
+	var bodies []string
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("reading request body: %v", err)
+		}
+		bodies = append(bodies, string(b))
+		if len(bodies) == 1 {
+			return newResp(req, http.StatusUnauthorized, nil), nil
+		}
+		return newResp(req, http.StatusOK, nil), nil
+	})
+
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		return &Token{AccessToken: "at-2"}, nil
+	}
+
+	tr := newTransport(base, fetcher, &Token{AccessToken: "at-1"})
+	tr.RetryOn401 = true
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/resource", strings.NewReader("hello-body"))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after the retry, got %d", resp.StatusCode)
+	}
+	if want := []string{"hello-body", "hello-body"}; len(bodies) != 2 || bodies[0] != want[0] || bodies[1] != want[1] {
+		t.Fatalf("expected both attempts to send %q, got %v", want, bodies)
+	}
+}
+
+// TestRoundTrip_DPoPNonceRetryResendsOriginalBody verifies the
+// unconditional DPoP nonce-challenge retry also resends the original
+// body rather than the drained first-attempt reader.
+func TestRoundTrip_DPoPNonceRetryResendsOriginalBody(t *testing.T) {
+	var bodies []string
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("reading request body: %v", err)
+		}
+		bodies = append(bodies, string(b))
+		if len(bodies) == 1 {
+			h := make(http.Header)
+			h.Set("DPoP-Nonce", "server-nonce-1")
+			h.Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+			return newResp(req, http.StatusUnauthorized, h), nil
+		}
+		return newResp(req, http.StatusOK, nil), nil
+	})
+
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		return nil, errors.New("fetcher should not be invoked for a nonce challenge")
+	}
+
+	tr := newTransport(base, fetcher, &Token{AccessToken: "at-1"})
+	tr.Authorizer = newDPoPAuthorizer(t)
+	tr.RetryOn401 = true
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/resource", strings.NewReader("hello-body"))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after resending with the nonce, got %d", resp.StatusCode)
+	}
+	if want := []string{"hello-body", "hello-body"}; len(bodies) != 2 || bodies[0] != want[0] || bodies[1] != want[1] {
+		t.Fatalf("expected both attempts to send %q, got %v", want, bodies)
+	}
+}
+
+// TestRewindBody_ErrorsWithoutGetBody verifies that a retry on a request
+// with a Body but no GetBody fails loudly instead of silently resending
+// an empty body.
+func TestRewindBody_ErrorsWithoutGetBody(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/resource", strings.NewReader("hello-body"))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.GetBody = nil
+
+	if err := rewindBody(req); err == nil {
+		t.Fatalf("expected an error when Body has no GetBody to rewind it with")
+	}
+}
+
+// TestRefreshToken_WaiterCancellationDoesNotAbortSharedFetch verifies
+// that a waiter whose own context is cancelled gets ctx.Err() back
+// without cutting short the in-flight refresh that other, healthy
+// callers are also waiting on.
+func TestRefreshToken_WaiterCancellationDoesNotAbortSharedFetch(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetcherCalls := 0
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		fetcherCalls++
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return &Token{AccessToken: "at-2"}, nil
+	}
+
+	tr := newTransport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return newResp(nil, http.StatusOK, nil), nil
+	}), fetcher, &Token{AccessToken: "at-1"})
+
+	leaderDone := make(chan error, 1)
+	go func() { leaderDone <- tr.RefreshToken(context.Background()) }()
+	<-started
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tr.RefreshToken(cancelledCtx); err != context.Canceled {
+		t.Fatalf("expected a cancelled waiter to get context.Canceled, got %v", err)
+	}
+
+	close(release)
+	if err := <-leaderDone; err != nil {
+		t.Fatalf("expected the leader's refresh to still succeed, got %v", err)
+	}
+	if fetcherCalls != 1 {
+		t.Fatalf("expected the fetch to run exactly once despite the cancelled waiter, got %d calls", fetcherCalls)
+	}
+	if got := tr.Token().AccessToken; got != "at-2" {
+		t.Fatalf("expected the refreshed token to be stored, got %q", got)
+	}
+}
+
+// TestRefreshToken_TimeoutBoundsSharedFetch verifies RefreshTimeout
+// applies to the shared fetch itself, independent of any caller's ctx.
+func TestRefreshToken_TimeoutBoundsSharedFetch(t *testing.T) {
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	tr := newTransport(nil, fetcher, &Token{AccessToken: "at-1"})
+	tr.RefreshTimeout = 10 * time.Millisecond
+
+	if err := tr.RefreshToken(context.Background()); err != context.DeadlineExceeded {
+		t.Fatalf("expected RefreshTimeout to bound the fetch with DeadlineExceeded, got %v", err)
+	}
+}
+
+// TestStartAutoRefresh_RefreshesImmediatelyWithNoToken verifies that a
+// Transport with no token yet fetches right away instead of waiting out
+// a full Leeway, which would otherwise apply to a nil token just as it
+// does to an expired one.
+func TestStartAutoRefresh_RefreshesImmediatelyWithNoToken(t *testing.T) {
+	refreshed := make(chan struct{})
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		close(refreshed)
+		return &Token{AccessToken: "at-1", Expiry: time.Now().Add(time.Hour)}, nil
+	}
+
+	tr := newTransport(nil, fetcher, nil)
+
+	tr.StartAutoRefresh(context.Background())
+	defer tr.Stop()
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("expected an immediate refresh for a Transport with no token yet")
+	}
+}
+
+// TestStartAutoRefresh_StopsGoroutineOnStop verifies that StartAutoRefresh
+// refreshes ahead of a short-lived token's expiry, and that Stop ends the
+// loop: once stopped, no further refreshes happen even as the new token
+// keeps expiring.
+func TestStartAutoRefresh_StopsGoroutineOnStop(t *testing.T) {
+	var calls int32
+	refreshed := make(chan struct{})
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(refreshed)
+		}
+		return &Token{AccessToken: "at-2", Expiry: time.Now().Add(20 * time.Millisecond)}, nil
+	}
+
+	tr := newTransport(nil, fetcher, &Token{AccessToken: "at-1", Expiry: time.Now().Add(20 * time.Millisecond)})
+	tr.Leeway = 5 * time.Millisecond
+
+	tr.StartAutoRefresh(context.Background())
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("expected at least one auto-refresh before stopping")
+	}
+
+	tr.Stop()
+	stopped := atomic.LoadInt32(&calls)
+	time.Sleep(200 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != stopped {
+		t.Fatalf("expected no further refreshes after Stop, calls went from %d to %d", stopped, got)
+	}
+}
+
+// TestStartAutoRefresh_IsNoOpIfAlreadyRunning verifies a second call
+// while a loop is already running doesn't start a competing one: a
+// single Stop is enough to end refreshing.
+func TestStartAutoRefresh_IsNoOpIfAlreadyRunning(t *testing.T) {
+	var calls int32
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		atomic.AddInt32(&calls, 1)
+		return &Token{AccessToken: "at-2", Expiry: time.Now().Add(20 * time.Millisecond)}, nil
+	}
+	tr := newTransport(nil, fetcher, &Token{AccessToken: "at-1", Expiry: time.Now().Add(20 * time.Millisecond)})
+	tr.Leeway = 5 * time.Millisecond
+
+	tr.StartAutoRefresh(context.Background())
+	tr.StartAutoRefresh(context.Background())
+
+	time.Sleep(50 * time.Millisecond)
+	tr.Stop()
+	stopped := atomic.LoadInt32(&calls)
+	if stopped == 0 {
+		t.Fatalf("expected at least one refresh before stopping")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != stopped {
+		t.Fatalf("expected a single Stop to end all refreshing, calls went from %d to %d", stopped, got)
+	}
+}
+
+// TestAutoRefreshLoop_BacksOffOnFailure verifies a failed background
+// refresh is recorded via LastRefreshError and that the loop holds off
+// before retrying rather than busy-looping.
+func TestAutoRefreshLoop_BacksOffOnFailure(t *testing.T) {
+	var calls int32
+	errFetch := errors.New("token endpoint unavailable")
+	fetcher := func(ctx context.Context, tok *Token) (*Token, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errFetch
+	}
+
+	tr := newTransport(nil, fetcher, &Token{AccessToken: "at-1", Expiry: time.Now().Add(5 * time.Millisecond)})
+	tr.Leeway = 1 * time.Millisecond
+
+	tr.StartAutoRefresh(context.Background())
+	defer tr.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for tr.LastRefreshError() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := tr.LastRefreshError(); err != errFetch {
+		t.Fatalf("expected LastRefreshError to report the failed attempt, got %v", err)
+	}
+
+	// autoRefreshLoop's initial backoff is a full second, so a retry
+	// shouldn't have landed yet.
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected the retry to be held back by backoff, got %d calls", got)
+	}
+}
+